@@ -0,0 +1,201 @@
+//+build windows
+
+package windows
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/vbatts/tar-split/tar/asm"
+	"github.com/vbatts/tar-split/tar/storage"
+)
+
+// tarSplitFileName is the name, relative to a layer's folder, of the
+// tar-split metadata blob captured while that layer's diff was applied.
+// Changes() and DiffSize() read it back instead of walking the (possibly
+// unmounted) filesystem.
+const tarSplitFileName = "tar-split.json.gz"
+
+// captureTarSplit wraps diff so that, as it is read by the layer-apply
+// code, every tar header it contains is also recorded to
+// <layerDir>/tar-split.json.gz. finish must be called (even on error) once
+// the returned reader has been fully consumed, to flush and close the
+// metadata file; on error, the partially written metadata is removed.
+func (d *Driver) captureTarSplit(id string, diff io.Reader) (tee io.Reader, finish func(error) error, err error) {
+	f, err := os.Create(filepath.Join(d.dir(id), tarSplitFileName))
+	if err != nil {
+		return nil, nil, err
+	}
+	gzw := gzip.NewWriter(f)
+	packer := storage.NewJSONPacker(gzw)
+
+	tee, err = asm.NewInputTarStream(diff, packer, nil)
+	if err != nil {
+		gzw.Close()
+		f.Close()
+		os.Remove(f.Name())
+		return nil, nil, err
+	}
+
+	finish = func(applyErr error) error {
+		gzErr := gzw.Close()
+		closeErr := f.Close()
+		if applyErr != nil {
+			os.Remove(f.Name())
+			return nil
+		}
+		if gzErr != nil {
+			return gzErr
+		}
+		return closeErr
+	}
+
+	return tee, finish, nil
+}
+
+// tarSplitEntries reads back the tar-split metadata captured for id,
+// returning the set of paths (tar header names, slash-separated) it
+// recorded. found is false when no tar-split metadata was ever captured
+// for this layer (it predates this driver's ApplyDiff-time capture, e.g.
+// a Windows base image or a layer created before this feature shipped).
+func tarSplitEntries(layerDir string) (paths map[string]bool, found bool, err error) {
+	f, err := os.Open(filepath.Join(layerDir, tarSplitFileName))
+	if os.IsNotExist(err) {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return nil, false, err
+	}
+	defer gzr.Close()
+
+	unpacker := storage.NewJSONUnpacker(gzr)
+	paths = make(map[string]bool)
+	for {
+		entry, err := unpacker.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, false, err
+		}
+		if entry.Type != storage.FileType {
+			continue
+		}
+		paths[filepath.ToSlash(entry.GetName())] = true
+	}
+
+	return paths, true, nil
+}
+
+// windowsWhiteoutToPath translates a classic ".wh."-prefixed whiteout entry,
+// the only tombstone format hcsshim's export emits, back into the path it
+// deletes, or returns ok=false if name isn't a whiteout.
+func windowsWhiteoutToPath(name string) (path string, ok bool) {
+	dir, base := filepath.Split(name)
+	if strings.HasPrefix(base, archive.WhiteoutPrefix) {
+		return filepath.ToSlash(filepath.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix))), true
+	}
+	return "", false
+}
+
+// Changes produces a list of changes between the specified layer and its
+// parent layer. Whiteout entries are reported as DELETE changes; if parent
+// is "", every other entry is reported as an ADD change. It is computed from the tar-split metadata captured for id and parent
+// during ApplyDiff, rather than by walking the (possibly unmounted)
+// filesystem.
+func (d *Driver) Changes(id, parent string) ([]archive.Change, error) {
+	rId, err := d.resolveId(id)
+	if err != nil {
+		return nil, err
+	}
+
+	layerEntries, found, err := tarSplitEntries(d.dir(rId))
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, fmt.Errorf("windows graphdriver: no tar-split metadata recorded for layer %s; Changes() is not supported for layers not produced by this driver's ApplyDiff", id)
+	}
+
+	var parentEntries map[string]bool
+	if parent != "" {
+		rPId, err := d.resolveId(parent)
+		if err != nil {
+			return nil, err
+		}
+		if parentEntries, _, err = tarSplitEntries(d.dir(rPId)); err != nil {
+			return nil, err
+		}
+	}
+
+	var changes []archive.Change
+	for name := range layerEntries {
+		if path, isWhiteout := windowsWhiteoutToPath(name); isWhiteout {
+			changes = append(changes, archive.Change{Path: filepath.ToSlash(path), Kind: archive.ChangeDelete})
+			continue
+		}
+
+		kind := archive.ChangeAdd
+		if parentEntries[name] {
+			kind = archive.ChangeModify
+		}
+		changes = append(changes, archive.Change{Path: name, Kind: kind})
+	}
+
+	return changes, nil
+}
+
+// DiffSize calculates the changes between the specified layer and its
+// parent and returns the size in bytes of the changes, using the
+// tar-split metadata captured during ApplyDiff rather than activating the
+// layer and walking its filesystem.
+func (d *Driver) DiffSize(id, parent string) (size int64, err error) {
+	rId, err := d.resolveId(id)
+	if err != nil {
+		return
+	}
+
+	f, err := os.Open(filepath.Join(d.dir(rId), tarSplitFileName))
+	if os.IsNotExist(err) {
+		return 0, fmt.Errorf("windows graphdriver: no tar-split metadata recorded for layer %s; DiffSize() is not supported for layers not produced by this driver's ApplyDiff", id)
+	} else if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return 0, err
+	}
+	defer gzr.Close()
+
+	unpacker := storage.NewJSONUnpacker(gzr)
+	for {
+		entry, uerr := unpacker.Next()
+		if uerr == io.EOF {
+			break
+		}
+		if uerr != nil {
+			return 0, uerr
+		}
+		if entry.Type != storage.FileType {
+			continue
+		}
+		if _, isWhiteout := windowsWhiteoutToPath(entry.GetName()); isWhiteout {
+			continue
+		}
+		size += entry.Size
+	}
+
+	return size, nil
+}
@@ -0,0 +1,48 @@
+//+build windows
+
+package windows
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestWindowsWhiteoutToPath(t *testing.T) {
+	cases := []struct {
+		name     string
+		wantPath string
+		wantOk   bool
+	}{
+		{"foo/bar.txt", "", false},
+		{"foo/.wh.bar.txt", "foo/bar.txt", true},
+		{".wh.bar.txt", "bar.txt", true},
+	}
+
+	for _, c := range cases {
+		path, ok := windowsWhiteoutToPath(c.name)
+		if ok != c.wantOk {
+			t.Errorf("windowsWhiteoutToPath(%q) ok = %v, want %v", c.name, ok, c.wantOk)
+			continue
+		}
+		if ok && path != c.wantPath {
+			t.Errorf("windowsWhiteoutToPath(%q) = %q, want %q", c.name, path, c.wantPath)
+		}
+	}
+}
+
+func TestTarSplitEntriesMissing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "windows-graphdriver-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(dir)
+
+	_, found, err := tarSplitEntries(dir)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if found {
+		t.Fatal("expected found = false for a directory with no tar-split metadata")
+	}
+}
@@ -0,0 +1,84 @@
+//+build windows
+
+package windows
+
+import (
+	"io"
+	"io/ioutil"
+	"path/filepath"
+
+	"github.com/docker/distribution/digest"
+)
+
+// diffIDFileName and chainIDFileName hold the content-addressable
+// identifiers computed for a layer during ApplyDiff, so that the
+// graphdriver can participate in content-addressable image IDs instead of
+// relying solely on remote-supplied ones.
+const (
+	diffIDFileName  = "diffid"
+	chainIDFileName = "chainid"
+)
+
+// diffIDReader wraps r so that everything read through it is also fed to
+// a digest.Canonical (SHA256) hash, from which DiffID can be computed once r has been
+// fully consumed.
+func diffIDReader(r io.Reader) (tee io.Reader, diffID func() digest.Digest) {
+	hasher := digest.Canonical.Hasher()
+	return io.TeeReader(r, hasher), func() digest.Digest {
+		return hasher.Digest()
+	}
+}
+
+// recordDigests persists the diffID computed for id, along with the
+// chainID derived by combining it with the parent's chainID (chainID =
+// SHA256(parentChainID + " " + diffID)).
+func (d *Driver) recordDigests(id, parent string, diffID digest.Digest) error {
+	if err := ioutil.WriteFile(filepath.Join(d.dir(id), diffIDFileName), []byte(diffID.String()), 0600); err != nil {
+		return err
+	}
+
+	// A parent that was never itself produced by this driver's ApplyDiff
+	// (a Windows base image restored via RestoreCustomImages, or a layer
+	// that predates this feature) has no chainid file recorded for it.
+	// Treat that the same way RestoreCustomImages does: fall back to
+	// chain-less rather than failing the whole ApplyDiff.
+	var parentChainID digest.Digest
+	if parent != "" {
+		if pChainID, err := d.ChainID(parent); err == nil {
+			parentChainID = pChainID
+		}
+	}
+
+	var chainID digest.Digest
+	if parentChainID == "" {
+		chainID = diffID
+	} else {
+		chainID = digest.Canonical.FromString(parentChainID.String() + " " + diffID.String())
+	}
+
+	return ioutil.WriteFile(filepath.Join(d.dir(id), chainIDFileName), []byte(chainID.String()), 0600)
+}
+
+// DiffID returns the digest of the uncompressed tar stream that produced
+// layer id's diff, as recorded during ApplyDiff.
+func (d *Driver) DiffID(id string) (digest.Digest, error) {
+	return d.readDigestFile(id, diffIDFileName)
+}
+
+// ChainID returns the content-addressable chain identifier for id: the
+// digest of its own diff combined with its parent's ChainID.
+func (d *Driver) ChainID(id string) (digest.Digest, error) {
+	return d.readDigestFile(id, chainIDFileName)
+}
+
+func (d *Driver) readDigestFile(id, name string) (digest.Digest, error) {
+	rId, err := d.resolveId(id)
+	if err != nil {
+		return "", err
+	}
+	content, err := ioutil.ReadFile(filepath.Join(d.dir(rId), name))
+	if err != nil {
+		return "", err
+	}
+	return digest.ParseDigest(string(content))
+}
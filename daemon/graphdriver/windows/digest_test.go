@@ -0,0 +1,65 @@
+//+build windows
+
+package windows
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/docker/distribution/digest"
+	"github.com/microsoft/hcsshim"
+)
+
+func TestDiffIDReader(t *testing.T) {
+	content := []byte("hello layer content")
+
+	tee, diffID := diffIDReader(bytes.NewReader(content))
+	if _, err := ioutil.ReadAll(tee); err != nil {
+		t.Fatalf("unexpected error reading tee: %s", err)
+	}
+
+	want := digest.Canonical.FromBytes(content)
+	if got := diffID(); got != want {
+		t.Errorf("diffID() = %s, want %s", got, want)
+	}
+}
+
+// TestRecordDigestsChainlessParent exercises recordDigests' fallback for a
+// parent that was never itself produced by this driver's ApplyDiff (e.g. a
+// Windows base image restored via RestoreCustomImages), which has no
+// chainid file recorded for it. recordDigests must not fail in that case --
+// it should fall back to treating id's own diffID as its chainID.
+func TestRecordDigestsChainlessParent(t *testing.T) {
+	home, err := ioutil.TempDir("", "windows-graphdriver-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(home)
+
+	d := &Driver{info: hcsshim.DriverInfo{HomeDir: home}}
+
+	const parentID = "parent"
+	const childID = "child"
+	if err := os.MkdirAll(d.dir(parentID), 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := os.MkdirAll(d.dir(childID), 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	// parentID deliberately has no chainid file.
+
+	diffID := digest.Canonical.FromBytes([]byte("child layer content"))
+	if err := d.recordDigests(childID, parentID, diffID); err != nil {
+		t.Fatalf("recordDigests: unexpected error: %s", err)
+	}
+
+	chainID, err := d.ChainID(childID)
+	if err != nil {
+		t.Fatalf("ChainID: unexpected error: %s", err)
+	}
+	if chainID != diffID {
+		t.Errorf("ChainID() = %s, want %s (diffID, chain-less fallback)", chainID, diffID)
+	}
+}
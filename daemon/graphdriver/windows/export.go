@@ -0,0 +1,90 @@
+//+build windows
+
+package windows
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/Microsoft/go-winio/archive/tar"
+	"github.com/Microsoft/go-winio/backuptar"
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/ioutils"
+	"github.com/docker/docker/pkg/random"
+	"github.com/microsoft/hcsshim"
+)
+
+// exportLayer generates a Windows-native tar stream, including security
+// descriptors, EAs, alternate data streams and reparse points, for the
+// layer identified by id.
+func (d *Driver) exportLayer(id string, parentLayerPaths []string) (arch archive.Archive, err error) {
+	layerFolder := d.dir(id)
+
+	tempFolder := layerFolder + "-" + strconv.FormatUint(uint64(random.Rand.Uint32()), 10)
+	if err = os.MkdirAll(tempFolder, 0755); err != nil {
+		logrus.Errorf("Could not create %s %s", tempFolder, err)
+		return
+	}
+	defer func() {
+		if err != nil {
+			_, folderName := filepath.Split(tempFolder)
+			if err2 := hcsshim.DestroyLayer(d.info, folderName); err2 != nil {
+				logrus.Warnf("Couldn't clean-up tempFolder: %s %s", tempFolder, err2)
+			}
+		}
+	}()
+
+	if err = hcsshim.ExportLayer(d.info, id, tempFolder, parentLayerPaths); err != nil {
+		return
+	}
+
+	r, w := io.Pipe()
+	go func() {
+		w.CloseWithError(writeBackupStreamFromTempFolder(w, tempFolder))
+	}()
+
+	return ioutils.NewReadCloserWrapper(r, func() error {
+		err := r.Close()
+		d.Put(id)
+		_, folderName := filepath.Split(tempFolder)
+		if err2 := hcsshim.DestroyLayer(d.info, folderName); err2 != nil {
+			logrus.Warnf("Couldn't clean-up tempFolder: %s %s", tempFolder, err2)
+		}
+		return err
+	}), nil
+}
+
+// writeBackupStreamFromTempFolder walks the files exported by hcsshim into
+// tempFolder and serializes each one, using a Windows BackupRead stream so
+// that security descriptors, EAs, alternate data streams and reparse points
+// are preserved in the resulting tar entry.
+func writeBackupStreamFromTempFolder(w io.Writer, tempFolder string) error {
+	tw := tar.NewWriter(w)
+	defer tw.Close()
+
+	return filepath.Walk(tempFolder, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == tempFolder {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(tempFolder, path)
+		if err != nil {
+			return err
+		}
+
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		name := filepath.ToSlash(relPath)
+		return backuptar.WriteTarFileFromBackupStream(tw, f, name, name, info.Size())
+	})
+}
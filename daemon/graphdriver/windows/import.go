@@ -0,0 +1,225 @@
+//+build windows
+
+package windows
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	winio "github.com/Microsoft/go-winio"
+	"github.com/Microsoft/go-winio/archive/tar"
+	"github.com/Microsoft/go-winio/backuptar"
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/random"
+	"github.com/microsoft/hcsshim"
+)
+
+// mutatedFiles is the set of UtilityVM files that hcsshim.ImportLayer
+// rewrites in place (the BCD hive used to boot the utility VM). Unless
+// these are captured before the import and restored afterward, repeated
+// pushes of an otherwise-identical layer produce diverging on-disk content
+// and therefore diverging digests.
+var mutatedFiles = map[string]string{
+	"UtilityVM/Files/EFI/Microsoft/Boot/BCD":      "bcd",
+	"UtilityVM/Files/EFI/Microsoft/Boot/BCD.LOG":  "bcd.log",
+	"UtilityVM/Files/EFI/Microsoft/Boot/BCD.LOG1": "bcd.log1",
+	"UtilityVM/Files/EFI/Microsoft/Boot/BCD.LOG2": "bcd.log2",
+}
+
+// noReexecEnv, when set to a non-empty value, keeps layer writes in the
+// daemon process instead of handing them off to the docker-windows-write-layer
+// reexec child. Intended for debugging only.
+const noReexecEnv = "DOCKER_WINDOWSFILTER_NOREEXEC"
+
+// importLayer extracts a Windows-native backup-stream tar into tempFolder,
+// restoring each file via the Windows Backup API, then hands the result to
+// hcsshim.ImportLayer. The heavy lifting is normally done by a reexeced
+// docker-windows-write-layer child so that a bad layer can't wedge the
+// daemon's Go runtime and can be cancelled by killing the child.
+func (d *Driver) importLayer(id string, layerData archive.Reader, parentLayerPaths []string) (size int64, err error) {
+	layerFolder := d.dir(id)
+
+	tempFolder := layerFolder + "-" + strconv.FormatUint(uint64(random.Rand.Uint32()), 10)
+	if err = os.MkdirAll(tempFolder, 0755); err != nil {
+		logrus.Errorf("Could not create %s %s", tempFolder, err)
+		return
+	}
+	defer func() {
+		_, folderName := filepath.Split(tempFolder)
+		if err2 := hcsshim.DestroyLayer(d.info, folderName); err2 != nil {
+			logrus.Warnf("Couldn't clean-up tempFolder: %s %s", tempFolder, err2)
+		}
+	}()
+
+	if os.Getenv(noReexecEnv) != "" {
+		size, err = writeLayerInProcess(layerData, tempFolder, parentLayerPaths)
+	} else {
+		size, err = writeLayerReexec(layerData, tempFolder, parentLayerPaths)
+	}
+	if err != nil {
+		return
+	}
+
+	// mutatedFiles snapshot lives next to tempFolder, not inside it --
+	// hcsshim.ImportLayer below imports tempFolder's entire contents as
+	// the layer, and the snapshot must not become part of that.
+	mutated, err := readMutatedFiles(tempFolder)
+	if err != nil {
+		return
+	}
+
+	if err = hcsshim.ImportLayer(d.info, id, tempFolder, parentLayerPaths); err != nil {
+		return
+	}
+
+	// The BCD hive files hcsshim.ImportLayer just mutated live in the
+	// persisted layer folder, not in tempFolder (which is about to be
+	// destroyed), so restore the pre-import snapshot there.
+	if err = restoreMutatedFiles(layerFolder, mutated); err != nil {
+		return
+	}
+
+	return
+}
+
+// writeLayerInProcess performs the backup-stream extraction directly in
+// the calling process. Used by writeLayerReexec's child, and by the parent
+// when DOCKER_WINDOWSFILTER_NOREEXEC is set.
+func writeLayerInProcess(layerData io.Reader, tempFolder string, parentLayerPaths []string) (int64, error) {
+	mutated := make(map[string][]byte)
+	size, err := writeBackupStreamToTempFolder(layerData, tempFolder, mutated)
+	if err != nil {
+		return size, err
+	}
+	return size, persistMutatedFiles(tempFolder, mutated)
+}
+
+// writeBackupStreamToTempFolder reads a Windows-native backup-stream tar,
+// restoring each entry's security descriptor, EAs, alternate data streams
+// and reparse points via a BackupStreamWriter. Entries matching
+// mutatedFiles are additionally buffered in mutated so they can be
+// restored again after hcsshim.ImportLayer has had a chance to rewrite
+// them.
+func writeBackupStreamToTempFolder(r io.Reader, tempFolder string, mutated map[string][]byte) (int64, error) {
+	tr := tar.NewReader(r)
+	var totalSize int64
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return totalSize, err
+		}
+
+		path := filepath.Join(tempFolder, filepath.FromSlash(hdr.Name))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			return totalSize, err
+		}
+
+		fileInfo, err := backuptar.FileInfoFromHeader(hdr)
+		if err != nil {
+			return totalSize, err
+		}
+
+		f, err := os.Create(path)
+		if err != nil {
+			return totalSize, err
+		}
+		if err := winio.SetFileBasicInfo(f, fileInfo); err != nil {
+			f.Close()
+			return totalSize, err
+		}
+
+		bw := winio.NewBackupStreamWriter(f)
+		n, err := io.Copy(bw, tr)
+		totalSize += n
+		closeErr := f.Close()
+		if err != nil {
+			return totalSize, err
+		}
+		if closeErr != nil {
+			return totalSize, closeErr
+		}
+
+		if mutatedName, ok := mutatedFiles[hdr.Name]; ok {
+			data, rerr := ioutil.ReadFile(path)
+			if rerr != nil {
+				return totalSize, rerr
+			}
+			mutated[mutatedName] = data
+		}
+	}
+
+	return totalSize, nil
+}
+
+// restoreMutatedFiles writes back the pre-import snapshot of any file that
+// hcsshim.ImportLayer is known to mutate, undoing that mutation so that
+// re-importing the same layer content is reproducible. layerFolder is the
+// persisted layer folder -- the destination hcsshim.ImportLayer actually
+// wrote to -- not the (by-then-destroyed) staging tempFolder.
+func restoreMutatedFiles(layerFolder string, mutated map[string][]byte) error {
+	for name, mutatedName := range mutatedFiles {
+		data, ok := mutated[mutatedName]
+		if !ok {
+			continue
+		}
+		path := filepath.Join(layerFolder, filepath.FromSlash(name))
+		if err := ioutil.WriteFile(path, data, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mutatedFilesSnapshotSuffix names the file the write-layer step (which
+// may be running in a separate reexeced process) leaves as a sibling of
+// tempFolder -- not inside it -- so the parent can restore the pre-import
+// snapshot once it has called hcsshim.ImportLayer, without the snapshot
+// itself being swept up as layer content.
+const mutatedFilesSnapshotSuffix = ".mutatedfiles.json"
+
+func mutatedFilesSnapshotPath(tempFolder string) string {
+	return tempFolder + mutatedFilesSnapshotSuffix
+}
+
+// persistMutatedFiles records the pre-import snapshot of mutated BCD files
+// to a sibling of tempFolder so it survives the write-layer step, even
+// when that step ran in a different process, without becoming part of
+// what hcsshim.ImportLayer imports from tempFolder.
+func persistMutatedFiles(tempFolder string, mutated map[string][]byte) error {
+	if len(mutated) == 0 {
+		return nil
+	}
+	content, err := json.Marshal(mutated)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(mutatedFilesSnapshotPath(tempFolder), content, 0600)
+}
+
+// readMutatedFiles loads the snapshot written by persistMutatedFiles, if
+// any, and removes it so it isn't left behind once the layer is written.
+func readMutatedFiles(tempFolder string) (map[string][]byte, error) {
+	path := mutatedFilesSnapshotPath(tempFolder)
+	content, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer os.Remove(path)
+
+	mutated := make(map[string][]byte)
+	if err := json.Unmarshal(content, &mutated); err != nil {
+		return nil, err
+	}
+	return mutated, nil
+}
@@ -0,0 +1,103 @@
+//+build windows
+
+package windows
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/Microsoft/go-winio/archive/tar"
+	"github.com/Microsoft/go-winio/backuptar"
+)
+
+// TestWriteBackupStreamRoundTripRestoresMutatedFiles drives a BCD-named file
+// through the same path a real import takes: writeBackupStreamToTempFolder
+// extracts it from a Windows-native backup-stream tar (built the same way
+// exportLayer builds one) while buffering its pre-import content,
+// persistMutatedFiles snapshots that buffer to disk, then -- after
+// simulating the mutation hcsshim.ImportLayer performs on the BCD hive in
+// the persisted layer folder -- restoreMutatedFiles must put the original,
+// pre-import content back.
+func TestWriteBackupStreamRoundTripRestoresMutatedFiles(t *testing.T) {
+	tempDir, err := ioutil.TempDir("", "windows-graphdriver-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(tempDir)
+
+	const bcdName = "UtilityVM/Files/EFI/Microsoft/Boot/BCD"
+	origContent := []byte("original bcd content")
+
+	srcFile := filepath.Join(tempDir, "BCD")
+	if err := ioutil.WriteFile(srcFile, origContent, 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	f, err := os.Open(srcFile)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	fi, err := f.Stat()
+	if err != nil {
+		f.Close()
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	var tarBuf bytes.Buffer
+	tw := tar.NewWriter(&tarBuf)
+	if err := backuptar.WriteTarFileFromBackupStream(tw, f, bcdName, bcdName, fi.Size()); err != nil {
+		f.Close()
+		t.Fatalf("WriteTarFileFromBackupStream: unexpected error: %s", err)
+	}
+	f.Close()
+	if err := tw.Close(); err != nil {
+		t.Fatalf("unexpected error closing tar writer: %s", err)
+	}
+
+	tempFolder := filepath.Join(tempDir, "temp")
+	mutated := make(map[string][]byte)
+	if _, err := writeBackupStreamToTempFolder(&tarBuf, tempFolder, mutated); err != nil {
+		t.Fatalf("writeBackupStreamToTempFolder: unexpected error: %s", err)
+	}
+	if len(mutated) != 1 {
+		t.Fatalf("writeBackupStreamToTempFolder: captured %d mutated files, want 1", len(mutated))
+	}
+
+	if err := persistMutatedFiles(tempFolder, mutated); err != nil {
+		t.Fatalf("persistMutatedFiles: unexpected error: %s", err)
+	}
+
+	restored, err := readMutatedFiles(tempFolder)
+	if err != nil {
+		t.Fatalf("readMutatedFiles: unexpected error: %s", err)
+	}
+	if len(restored) != len(mutated) {
+		t.Fatalf("readMutatedFiles: got %d entries, want %d", len(restored), len(mutated))
+	}
+
+	// Simulate hcsshim.ImportLayer rewriting the BCD hive in the persisted
+	// layer folder (not tempFolder, which is scratch space by this point).
+	layerFolder := filepath.Join(tempDir, "layer")
+	bcdPath := filepath.Join(layerFolder, filepath.FromSlash(bcdName))
+	if err := os.MkdirAll(filepath.Dir(bcdPath), 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := ioutil.WriteFile(bcdPath, []byte("mutated by ImportLayer"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	if err := restoreMutatedFiles(layerFolder, restored); err != nil {
+		t.Fatalf("restoreMutatedFiles: unexpected error: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(bcdPath)
+	if err != nil {
+		t.Fatalf("unexpected error reading restored file: %s", err)
+	}
+	if string(got) != string(origContent) {
+		t.Errorf("restored content = %q, want %q (pre-import content)", got, origContent)
+	}
+}
@@ -0,0 +1,111 @@
+//+build windows
+
+package windows
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/docker/docker/pkg/reexec"
+)
+
+const writeLayerReexecName = "docker-windows-write-layer"
+
+func init() {
+	reexec.Register(writeLayerReexecName, writeLayerReexecMain)
+}
+
+// writeLayerReexecArgs is written by the parent as a single JSON line on
+// the child's stdin, immediately before the raw tar stream.
+type writeLayerReexecArgs struct {
+	TempFolder       string   `json:"tempFolder"`
+	ParentLayerPaths []string `json:"parentLayerPaths"`
+}
+
+// writeLayerReexec hands the backup-stream extraction off to a
+// docker-windows-write-layer child so that a bad layer can't wedge the
+// daemon's Go runtime, and so a stuck import can be cancelled by killing
+// the child. The parent layer paths are sent as a JSON header line on
+// stdin, followed immediately by the tar stream; the child writes the
+// applied size back as a single line on stdout.
+func writeLayerReexec(layerData io.Reader, tempFolder string, parentLayerPaths []string) (size int64, err error) {
+	cmd := reexec.Command(writeLayerReexecName)
+	cmd.Stderr = os.Stderr
+
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return 0, err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return 0, err
+	}
+
+	if err = cmd.Start(); err != nil {
+		return 0, err
+	}
+
+	header, err := json.Marshal(writeLayerReexecArgs{
+		TempFolder:       tempFolder,
+		ParentLayerPaths: parentLayerPaths,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	go func() {
+		defer stdin.Close()
+		if _, werr := stdin.Write(append(header, '\n')); werr != nil {
+			logrus.Warnf("writeLayerReexec: failed to write args to child: %s", werr)
+			return
+		}
+		if _, werr := io.Copy(stdin, layerData); werr != nil {
+			logrus.Warnf("writeLayerReexec: failed to stream layer to child: %s", werr)
+		}
+	}()
+
+	if _, err = fmt.Fscanf(stdout, "%d\n", &size); err != nil {
+		cmd.Wait()
+		return 0, err
+	}
+
+	if err = cmd.Wait(); err != nil {
+		return 0, err
+	}
+
+	return size, nil
+}
+
+// writeLayerReexecMain is the docker-windows-write-layer entrypoint. It
+// reads the JSON header line followed by the tar stream from stdin,
+// extracts it into the temp folder named in the header, and reports the
+// applied size on stdout.
+func writeLayerReexecMain() {
+	var args writeLayerReexecArgs
+	dec := json.NewDecoder(os.Stdin)
+	if err := dec.Decode(&args); err != nil {
+		fmt.Fprintf(os.Stderr, "%s: decoding args: %s\n", writeLayerReexecName, err)
+		os.Exit(1)
+	}
+
+	// The decoder stops at the header's closing brace, leaving the newline
+	// that ends the header line unread; drop it so the tar stream starts at
+	// its first header block.
+	stream := io.MultiReader(dec.Buffered(), os.Stdin)
+	var nl [1]byte
+	if _, err := io.ReadFull(stream, nl[:]); err != nil || nl[0] != '\n' {
+		fmt.Fprintf(os.Stderr, "%s: args header line is not newline-terminated\n", writeLayerReexecName)
+		os.Exit(1)
+	}
+
+	size, err := writeLayerInProcess(stream, args.TempFolder, args.ParentLayerPaths)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%s: %s\n", writeLayerReexecName, err)
+		os.Exit(1)
+	}
+
+	fmt.Fprintf(os.Stdout, "%d\n", size)
+}
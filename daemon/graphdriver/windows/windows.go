@@ -21,8 +21,8 @@ import (
 	"github.com/docker/docker/image"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/docker/docker/pkg/chrootarchive"
-	"github.com/docker/docker/pkg/ioutils"
-	"github.com/docker/docker/pkg/random"
+	"github.com/docker/docker/pkg/containerfs"
+	units "github.com/docker/go-units"
 	"github.com/microsoft/hcsshim"
 )
 
@@ -34,23 +34,43 @@ func init() {
 const (
 	diffDriver = iota
 	filterDriver
+	// lcowDriver identifies a future Linux-Containers-on-Windows flavour,
+	// whose rootfs lives inside a utility VM rather than at a host
+	// path. It is not yet registered or constructible; it exists so that
+	// Driver.Get's containerfs.ContainerFS return type has somewhere to
+	// grow into a non-host-visible implementation.
+	lcowDriver
 )
 
+// defaultSandboxSize is the size given to a read/write layer's sandbox
+// VHD when neither the driver nor the layer's storage-opts specify one.
+const defaultSandboxSize = 127 * 1024 * 1024 * 1024 // 127GB
+
 type Driver struct {
 	info       hcsshim.DriverInfo
 	sync.Mutex // Protects concurrent modification to active
 	active     map[string]int
+
+	// defaultSandboxSize is the driver-wide default sandbox size,
+	// configurable via a `size=` daemon storage option and overridable
+	// per layer with a `size` storage-opt passed to CreateReadWrite.
+	defaultSandboxSize uint64
 }
 
 // New returns a new Windows storage filter driver.
 func InitFilter(home string, options []string) (graphdriver.Driver, error) {
 	logrus.Debugf("WindowsGraphDriver InitFilter at %s", home)
+	size, err := parseDefaultSandboxSize(options)
+	if err != nil {
+		return nil, err
+	}
 	d := &Driver{
 		info: hcsshim.DriverInfo{
 			HomeDir: home,
 			Flavour: filterDriver,
 		},
-		active: make(map[string]int),
+		active:             make(map[string]int),
+		defaultSandboxSize: size,
 	}
 	return d, nil
 }
@@ -58,22 +78,47 @@ func InitFilter(home string, options []string) (graphdriver.Driver, error) {
 // New returns a new Windows differencing disk driver.
 func InitDiff(home string, options []string) (graphdriver.Driver, error) {
 	logrus.Debugf("WindowsGraphDriver InitDiff at %s", home)
+	size, err := parseDefaultSandboxSize(options)
+	if err != nil {
+		return nil, err
+	}
 	d := &Driver{
 		info: hcsshim.DriverInfo{
 			HomeDir: home,
 			Flavour: diffDriver,
 		},
-		active: make(map[string]int),
+		active:             make(map[string]int),
+		defaultSandboxSize: size,
 	}
 	return d, nil
 }
 
+// parseDefaultSandboxSize looks for a `size=<quantity>` entry in the
+// driver options passed to InitFilter/InitDiff, returning defaultSandboxSize
+// if none is present.
+func parseDefaultSandboxSize(options []string) (uint64, error) {
+	for _, option := range options {
+		parts := strings.SplitN(option, "=", 2)
+		if len(parts) != 2 || strings.ToLower(parts[0]) != "size" {
+			continue
+		}
+		size, err := units.RAMInBytes(parts[1])
+		if err != nil {
+			return 0, fmt.Errorf("invalid size option %q: %s", parts[1], err)
+		}
+		return uint64(size), nil
+	}
+	return defaultSandboxSize, nil
+}
+
 func (d *Driver) String() string {
 	switch d.info.Flavour {
 	case diffDriver:
 		return "windowsdiff"
 	case filterDriver:
 		return "windowsfilter"
+	case lcowDriver:
+		return "windowslcow"
 	default:
 		return "Unknown driver flavour"
 	}
@@ -99,7 +144,29 @@ func (d *Driver) Exists(id string) bool {
 	return result
 }
 
+// Create creates a new layer with the given id and parent, without
+// storage-opts: a sandbox of the driver's default size when parent is an
+// "-init" layer, otherwise a read-only layer. Use CreateReadWrite to create
+// a sandbox with a custom size.
 func (d *Driver) Create(id, parent string) error {
+	return d.create(id, parent, nil)
+}
+
+// CreateReadWrite creates a new layer with the given id and parent, as
+// Create does, honoring opts. The layer is a read/write sandbox only when
+// parent is an "-init" layer; a `size` storage-opt, parsed as a quantity
+// (e.g. "50GB"), then overrides the driver's default sandbox VHD size.
+// For any other parent a read-only layer is created, and any storage-opt
+// is rejected with an error.
+func (d *Driver) CreateReadWrite(id, parent string, opts *graphdriver.CreateOpts) error {
+	var storageOpt map[string]string
+	if opts != nil {
+		storageOpt = opts.StorageOpt
+	}
+	return d.create(id, parent, storageOpt)
+}
+
+func (d *Driver) create(id, parent string, storageOpt map[string]string) error {
 	rPId, err := d.resolveId(parent)
 	if err != nil {
 		return err
@@ -124,14 +191,27 @@ func (d *Driver) Create(id, parent string) error {
 
 	layerChain = append(layerChain, parentChain...)
 
+	var sandboxSize uint64
 	if parentIsInit {
 		if len(layerChain) == 0 {
 			return fmt.Errorf("Cannot create a read/write layer without a parent layer.")
 		}
+		if sandboxSize, err = sandboxSizeFromStorageOpt(storageOpt, d.defaultSandboxSize); err != nil {
+			return err
+		}
 		if err := hcsshim.CreateSandboxLayer(d.info, id, layerChain[0], layerChain); err != nil {
 			return err
 		}
+		if err := hcsshim.ExpandSandboxSize(d.info, id, sandboxSize); err != nil {
+			if err2 := hcsshim.DestroyLayer(d.info, id); err2 != nil {
+				logrus.Warnf("Failed to DestroyLayer %s: %s", id, err2)
+			}
+			return err
+		}
 	} else {
+		if len(storageOpt) > 0 {
+			return fmt.Errorf("--storage-opt is not supported for this layer")
+		}
 		if err := hcsshim.CreateLayer(d.info, id, rPId); err != nil {
 			return err
 		}
@@ -151,9 +231,32 @@ func (d *Driver) Create(id, parent string) error {
 		return err
 	}
 
+	if parentIsInit {
+		if err := d.setSandboxSize(id, sandboxSize); err != nil {
+			if err2 := hcsshim.DestroyLayer(d.info, id); err2 != nil {
+				logrus.Warnf("Failed to DestroyLayer %s: %s", id, err2)
+			}
+			return err
+		}
+	}
+
 	return nil
 }
 
+// sandboxSizeFromStorageOpt parses the `size` entry of a CreateReadWrite
+// storage-opt map, falling back to def when it isn't present.
+func sandboxSizeFromStorageOpt(storageOpt map[string]string, def uint64) (uint64, error) {
+	raw, ok := storageOpt["size"]
+	if !ok {
+		return def, nil
+	}
+	size, err := units.RAMInBytes(raw)
+	if err != nil {
+		return 0, fmt.Errorf("invalid size storage-opt %q: %s", raw, err)
+	}
+	return uint64(size), nil
+}
+
 func (d *Driver) dir(id string) string {
 	return filepath.Join(d.info.HomeDir, filepath.Base(id))
 }
@@ -168,8 +271,12 @@ func (d *Driver) Remove(id string) error {
 	return hcsshim.DestroyLayer(d.info, rId)
 }
 
-// Get returns the rootfs path for the id. This will mount the dir at it's given path
-func (d *Driver) Get(id, mountLabel string) (string, error) {
+// Get returns a ContainerFS for the id. This will mount the dir at its
+// given path. The Windows filter driver's rootfs is always host-visible,
+// so this wraps the mounted path in a containerfs.Local; a future LCOW
+// flavour, whose rootfs lives inside a utility VM, would instead return a
+// ContainerFS backed by a guest RPC channel.
+func (d *Driver) Get(id, mountLabel string) (containerfs.ContainerFS, error) {
 	logrus.Debugf("WindowsGraphDriver Get() id %s mountLabel %s", id, mountLabel)
 	var dir string
 
@@ -178,24 +285,24 @@ func (d *Driver) Get(id, mountLabel string) (string, error) {
 
 	rId, err := d.resolveId(id)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	// Getting the layer paths must be done outside of the lock.
 	layerChain, err := d.getLayerChain(rId)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 
 	if d.active[rId] == 0 {
 		if err := hcsshim.ActivateLayer(d.info, rId); err != nil {
-			return "", err
+			return nil, err
 		}
 		if err := hcsshim.PrepareLayer(d.info, rId, layerChain); err != nil {
 			if err2 := hcsshim.DeactivateLayer(d.info, rId); err2 != nil {
 				logrus.Warnf("Failed to Deactivate %s: %s", id, err)
 			}
-			return "", err
+			return nil, err
 		}
 	}
 
@@ -204,7 +311,7 @@ func (d *Driver) Get(id, mountLabel string) (string, error) {
 		if err2 := hcsshim.DeactivateLayer(d.info, rId); err2 != nil {
 			logrus.Warnf("Failed to Deactivate %s: %s", id, err)
 		}
-		return "", err
+		return nil, err
 	}
 
 	d.active[rId]++
@@ -217,7 +324,7 @@ func (d *Driver) Get(id, mountLabel string) (string, error) {
 		dir = d.dir(id)
 	}
 
-	return dir, nil
+	return containerfs.NewLocal(dir), nil
 }
 
 func (d *Driver) Put(id string) error {
@@ -296,27 +403,40 @@ func (d *Driver) Diff(id, parent string) (arch archive.Archive, err error) {
 	return d.exportLayer(rId, layerChain)
 }
 
-// Changes produces a list of changes between the specified layer
-// and its parent layer. If parent is "", then all changes will be ADD changes.
-func (d *Driver) Changes(id, parent string) ([]archive.Change, error) {
-	return nil, fmt.Errorf("The Windows graphdriver does not support Changes()")
-}
-
 // ApplyDiff extracts the changeset from the given diff into the
 // layer with the specified id and parent, returning the size of the
-// new layer in bytes.
+// new layer in bytes. As the diff is applied, a tar-split metadata blob
+// is captured alongside the layer so that Changes() and DiffSize() can
+// later be computed without re-walking the filesystem.
 func (d *Driver) ApplyDiff(id, parent string, diff archive.Reader) (size int64, err error) {
 	rPId, err := d.resolveId(parent)
 	if err != nil {
 		return
 	}
 
+	tee, finish, err := d.captureTarSplit(id, diff)
+	if err != nil {
+		return
+	}
+	defer func() {
+		if ferr := finish(err); ferr != nil && err == nil {
+			err = ferr
+		}
+	}()
+
+	tee, diffID := diffIDReader(tee)
+	defer func() {
+		if err == nil {
+			err = d.recordDigests(id, parent, diffID())
+		}
+	}()
+
 	if d.info.Flavour == diffDriver {
 		start := time.Now().UTC()
 		logrus.Debugf("WindowsGraphDriver ApplyDiff: Start untar layer")
 		destination := d.dir(id)
 		destination = filepath.Dir(destination)
-		if size, err = chrootarchive.ApplyUncompressedLayer(destination, diff); err != nil {
+		if size, err = chrootarchive.ApplyUncompressedLayer(destination, tee); err != nil {
 			return
 		}
 		logrus.Debugf("WindowsGraphDriver ApplyDiff: Untar time: %vs", time.Now().UTC().Sub(start).Seconds())
@@ -335,7 +455,7 @@ func (d *Driver) ApplyDiff(id, parent string, diff archive.Reader) (size int64,
 	layerChain := []string{parentPath}
 	layerChain = append(layerChain, parentChain...)
 
-	if size, err = d.importLayer(id, diff, layerChain); err != nil {
+	if size, err = d.importLayer(id, tee, layerChain); err != nil {
 		return
 	}
 
@@ -346,29 +466,6 @@ func (d *Driver) ApplyDiff(id, parent string, diff archive.Reader) (size int64,
 	return
 }
 
-// DiffSize calculates the changes between the specified layer
-// and its parent and returns the size in bytes of the changes
-// relative to its base filesystem directory.
-func (d *Driver) DiffSize(id, parent string) (size int64, err error) {
-	rPId, err := d.resolveId(parent)
-	if err != nil {
-		return
-	}
-
-	changes, err := d.Changes(id, rPId)
-	if err != nil {
-		return
-	}
-
-	layerFs, err := d.Get(id, "")
-	if err != nil {
-		return
-	}
-	defer d.Put(id)
-
-	return archive.ChangesSize(layerFs, changes), nil
-}
-
 func (d *Driver) RestoreCustomImages(tagger graphdriver.Tagger, recorder graphdriver.Recorder) (imageIDs []string, err error) {
 	strData, err := hcsshim.GetSharedBaseImages()
 	if err != nil {
@@ -399,7 +496,19 @@ func (d *Driver) RestoreCustomImages(tagger graphdriver.Tagger, recorder graphdr
 
 		// Use crypto hash of the foldername to generate a docker style id.
 		h := sha512.Sum384([]byte(folderName))
-		id := fmt.Sprintf("%x", h[:32])
+		legacyID := fmt.Sprintf("%x", h[:32])
+
+		// Prefer deriving the id from this layer's digest chain, so that
+		// it participates in content-addressable image IDs. The legacy
+		// sha512(folderName) id is kept when it's already registered, so
+		// existing users' caches aren't invalidated, and is also used when
+		// no chain ID was recorded for the layer.
+		id := legacyID
+		if !recorder.Exists(legacyID) {
+			if chainID, err := d.ChainID(folderName); err == nil {
+				id = chainID.Hex()
+			}
+		}
 
 		if !recorder.Exists(id) {
 			// Register the image.
@@ -436,73 +545,34 @@ func (d *Driver) RestoreCustomImages(tagger graphdriver.Tagger, recorder graphdr
 func (d *Driver) GetMetadata(id string) (map[string]string, error) {
 	m := make(map[string]string)
 	m["dir"] = d.dir(id)
+	if size, ok, err := d.getSandboxSize(id); err != nil {
+		return nil, err
+	} else if ok {
+		m["size"] = strconv.FormatUint(size, 10)
+	}
 	return m, nil
 }
 
-func (d *Driver) exportLayer(id string, parentLayerPaths []string) (arch archive.Archive, err error) {
-	layerFolder := d.dir(id)
-
-	tempFolder := layerFolder + "-" + strconv.FormatUint(uint64(random.Rand.Uint32()), 10)
-	if err = os.MkdirAll(tempFolder, 0755); err != nil {
-		logrus.Errorf("Could not create %s %s", tempFolder, err)
-		return
-	}
-	defer func() {
-		if err != nil {
-			_, folderName := filepath.Split(tempFolder)
-			if err2 := hcsshim.DestroyLayer(d.info, folderName); err2 != nil {
-				logrus.Warnf("Couldn't clean-up tempFolder: %s %s", tempFolder, err2)
-			}
-		}
-	}()
-
-	if err = hcsshim.ExportLayer(d.info, id, tempFolder, parentLayerPaths); err != nil {
-		return
-	}
-
-	archive, err := archive.Tar(tempFolder, archive.Uncompressed)
-	if err != nil {
-		return
-	}
-	return ioutils.NewReadCloserWrapper(archive, func() error {
-		err := archive.Close()
-		d.Put(id)
-		_, folderName := filepath.Split(tempFolder)
-		if err2 := hcsshim.DestroyLayer(d.info, folderName); err2 != nil {
-			logrus.Warnf("Couldn't clean-up tempFolder: %s %s", tempFolder, err2)
-		}
-		return err
-	}), nil
-
+// setSandboxSize records the effective sandbox VHD size used when id was
+// created, so it can later be surfaced through GetMetadata.
+func (d *Driver) setSandboxSize(id string, size uint64) error {
+	return ioutil.WriteFile(filepath.Join(d.dir(id), "sandboxsize"), []byte(strconv.FormatUint(size, 10)), 0600)
 }
 
-func (d *Driver) importLayer(id string, layerData archive.Reader, parentLayerPaths []string) (size int64, err error) {
-	layerFolder := d.dir(id)
-
-	tempFolder := layerFolder + "-" + strconv.FormatUint(uint64(random.Rand.Uint32()), 10)
-	if err = os.MkdirAll(tempFolder, 0755); err != nil {
-		logrus.Errorf("Could not create %s %s", tempFolder, err)
-		return
-	}
-	defer func() {
-		_, folderName := filepath.Split(tempFolder)
-		if err2 := hcsshim.DestroyLayer(d.info, folderName); err2 != nil {
-			logrus.Warnf("Couldn't clean-up tempFolder: %s %s", tempFolder, err2)
-		}
-	}()
-
-	start := time.Now().UTC()
-	logrus.Debugf("Start untar layer")
-	if size, err = chrootarchive.ApplyLayer(tempFolder, layerData); err != nil {
-		return
+// getSandboxSize returns the size recorded by setSandboxSize for id, if
+// any -- non-sandbox layers have no recorded size.
+func (d *Driver) getSandboxSize(id string) (size uint64, ok bool, err error) {
+	content, err := ioutil.ReadFile(filepath.Join(d.dir(id), "sandboxsize"))
+	if os.IsNotExist(err) {
+		return 0, false, nil
+	} else if err != nil {
+		return 0, false, err
 	}
-	logrus.Debugf("Untar time: %vs", time.Now().UTC().Sub(start).Seconds())
-
-	if err = hcsshim.ImportLayer(d.info, id, tempFolder, parentLayerPaths); err != nil {
-		return
+	size, err = strconv.ParseUint(string(content), 10, 64)
+	if err != nil {
+		return 0, false, fmt.Errorf("Failed to parse sandboxsize file - %s", err)
 	}
-
-	return
+	return size, true, nil
 }
 
 func (d *Driver) resolveId(id string) (string, error) {
@@ -0,0 +1,49 @@
+// Package containerfs provides a filesystem abstraction for a container's
+// rootfs so that callers don't have to assume it is reachable as a host
+// path. Most graphdrivers mount their layers locally and can satisfy this
+// with a thin wrapper (see Local), but a driver whose rootfs lives inside
+// a utility VM -- reachable only over a guest RPC channel -- can implement
+// it directly instead.
+package containerfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/archive"
+)
+
+// ContainerFS is a handle on a container's root filesystem, as returned by
+// a graphdriver's Get. Path returns a host path only when one exists;
+// callers that need to read or write files should prefer Open/Stat/Walk,
+// which work even when the rootfs isn't host-visible.
+type ContainerFS interface {
+	// Path returns the local path to the root of the filesystem, for
+	// drivers where that is meaningful. Implementations for which it
+	// isn't (e.g. a rootfs inside a utility VM) may return "".
+	Path() string
+
+	// Open opens the named file relative to the root of the filesystem.
+	Open(path string) (*os.File, error)
+
+	// Stat returns file info for the named file relative to the root of
+	// the filesystem.
+	Stat(path string) (os.FileInfo, error)
+
+	// Walk walks the filesystem tree rooted at path, relative to the
+	// root of the filesystem, calling walkFn for each file or directory.
+	Walk(path string, walkFn filepath.WalkFunc) error
+
+	// ResolveScopedPath evaluates the given path, scoped to the root of
+	// the filesystem, resolving symlinks and guarding against escapes
+	// via `..`, and returns the resulting path relative to the root.
+	ResolveScopedPath(path string, rawPath bool) (string, error)
+
+	// Archive returns a tar archive of path, relative to the root of the
+	// filesystem, for use by `docker cp`.
+	Archive(path string) (archive.Archive, error)
+
+	// ExtractArchive extracts src into path, relative to the root of the
+	// filesystem, for use by `docker cp` and builder COPY/ADD.
+	ExtractArchive(path string, src archive.Reader) error
+}
@@ -0,0 +1,77 @@
+package containerfs
+
+import (
+	"os"
+	"path/filepath"
+
+	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/docker/pkg/symlink"
+)
+
+// Local is a ContainerFS backed by a directory on the host's own
+// filesystem. It is what every graphdriver flavour used before LCOW, and
+// what the Windows filter driver still uses today.
+type Local struct {
+	root string
+}
+
+// NewLocal returns a ContainerFS rooted at root, a host directory.
+func NewLocal(root string) *Local {
+	return &Local{root: root}
+}
+
+// Path returns the host path to the root of the filesystem.
+func (l *Local) Path() string {
+	return l.root
+}
+
+// Open opens the named file relative to the root of the filesystem.
+func (l *Local) Open(path string) (*os.File, error) {
+	return os.Open(filepath.Join(l.root, path))
+}
+
+// Stat returns file info for the named file relative to the root of the
+// filesystem.
+func (l *Local) Stat(path string) (os.FileInfo, error) {
+	return os.Stat(filepath.Join(l.root, path))
+}
+
+// Walk walks the filesystem tree rooted at path, relative to the root of
+// the filesystem.
+func (l *Local) Walk(path string, walkFn filepath.WalkFunc) error {
+	return filepath.Walk(filepath.Join(l.root, path), walkFn)
+}
+
+// ResolveScopedPath evaluates path, scoped to the root of the filesystem,
+// resolving symlinks and guarding against escapes via `..`, and returns
+// the resulting path relative to the root in both cases. When rawPath is
+// false (the common case), path is first cleaned as though rooted at "/"
+// -- so a path like "../../etc/passwd" is treated as
+// "/etc/passwd" scoped to the root rather than walked upward -- before
+// symlinks are resolved. When rawPath is true, path is joined to the root
+// and resolved exactly as given, for callers that have already validated
+// or constructed it relative to the root themselves.
+func (l *Local) ResolveScopedPath(path string, rawPath bool) (string, error) {
+	cleaned := path
+	if !rawPath {
+		cleaned = filepath.Clean(string(filepath.Separator) + path)
+	}
+
+	resolved, err := symlink.FollowSymlinkInScope(filepath.Join(l.root, cleaned), l.root)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Rel(l.root, resolved)
+}
+
+// Archive returns a tar archive of path, relative to the root of the
+// filesystem.
+func (l *Local) Archive(path string) (archive.Archive, error) {
+	return archive.Tar(filepath.Join(l.root, path), archive.Uncompressed)
+}
+
+// ExtractArchive extracts src into path, relative to the root of the
+// filesystem.
+func (l *Local) ExtractArchive(path string, src archive.Reader) error {
+	return archive.Untar(src, filepath.Join(l.root, path), nil)
+}
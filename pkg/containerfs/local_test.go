@@ -0,0 +1,175 @@
+package containerfs
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLocalPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "containerfs-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	fs := NewLocal(root)
+	if fs.Path() != root {
+		t.Errorf("Path() = %q, want %q", fs.Path(), root)
+	}
+}
+
+func TestLocalOpenAndStat(t *testing.T) {
+	root, err := ioutil.TempDir("", "containerfs-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	content := []byte("hello")
+	if err := ioutil.WriteFile(filepath.Join(root, "foo.txt"), content, 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fs := NewLocal(root)
+
+	fi, err := fs.Stat("foo.txt")
+	if err != nil {
+		t.Fatalf("Stat: unexpected error: %s", err)
+	}
+	if fi.Size() != int64(len(content)) {
+		t.Errorf("Stat().Size() = %d, want %d", fi.Size(), len(content))
+	}
+
+	f, err := fs.Open("foo.txt")
+	if err != nil {
+		t.Fatalf("Open: unexpected error: %s", err)
+	}
+	defer f.Close()
+
+	got, err := ioutil.ReadAll(f)
+	if err != nil {
+		t.Fatalf("unexpected error reading file: %s", err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("read %q, want %q", got, content)
+	}
+}
+
+func TestLocalWalk(t *testing.T) {
+	root, err := ioutil.TempDir("", "containerfs-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sub", "bar.txt"), []byte("x"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fs := NewLocal(root)
+
+	var seen []string
+	err = fs.Walk(".", func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, rerr := filepath.Rel(root, path)
+		if rerr != nil {
+			return rerr
+		}
+		seen = append(seen, filepath.ToSlash(rel))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Walk: unexpected error: %s", err)
+	}
+
+	found := false
+	for _, p := range seen {
+		if p == "sub/bar.txt" {
+			found = true
+		}
+	}
+	if !found {
+		t.Errorf("Walk did not visit sub/bar.txt, saw %v", seen)
+	}
+}
+
+func TestLocalResolveScopedPath(t *testing.T) {
+	root, err := ioutil.TempDir("", "containerfs-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	if err := os.MkdirAll(filepath.Join(root, "sub"), 0755); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	if err := ioutil.WriteFile(filepath.Join(root, "sub", "bar.txt"), []byte("x"), 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	fs := NewLocal(root)
+
+	resolved, err := fs.ResolveScopedPath("sub/bar.txt", false)
+	if err != nil {
+		t.Fatalf("ResolveScopedPath: unexpected error: %s", err)
+	}
+	if filepath.ToSlash(resolved) != "sub/bar.txt" {
+		t.Errorf("ResolveScopedPath(%q) = %q, want %q", "sub/bar.txt", resolved, "sub/bar.txt")
+	}
+
+	// A `..`-escape attempt must be scoped back under root, not allowed
+	// to walk above it.
+	resolved, err = fs.ResolveScopedPath("../../etc/passwd", false)
+	if err != nil {
+		t.Fatalf("ResolveScopedPath: unexpected error: %s", err)
+	}
+	if rel, rerr := filepath.Rel(root, filepath.Join(root, resolved)); rerr != nil || rel == ".." || len(rel) >= 2 && rel[:2] == ".." {
+		t.Errorf("ResolveScopedPath(%q) = %q escapes root %q", "../../etc/passwd", resolved, root)
+	}
+}
+
+func TestLocalArchiveExtractArchiveRoundtrip(t *testing.T) {
+	root, err := ioutil.TempDir("", "containerfs-test-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(root)
+
+	src, err := ioutil.TempDir("", "containerfs-test-src-")
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	defer os.RemoveAll(src)
+
+	content := []byte("archived content")
+	if err := ioutil.WriteFile(filepath.Join(src, "baz.txt"), content, 0644); err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+
+	srcFs := NewLocal(src)
+	arch, err := srcFs.Archive(".")
+	if err != nil {
+		t.Fatalf("Archive: unexpected error: %s", err)
+	}
+	defer arch.Close()
+
+	dstFs := NewLocal(root)
+	if err := dstFs.ExtractArchive(".", arch); err != nil {
+		t.Fatalf("ExtractArchive: unexpected error: %s", err)
+	}
+
+	got, err := ioutil.ReadFile(filepath.Join(root, "baz.txt"))
+	if err != nil {
+		t.Fatalf("unexpected error reading extracted file: %s", err)
+	}
+	if string(got) != string(content) {
+		t.Errorf("extracted content = %q, want %q", got, content)
+	}
+}